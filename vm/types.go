@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"regexp/syntax"
 	"strings"
-	"sync"
 
 	"github.com/go-test/deep"
 	"github.com/golang/glog"
@@ -22,51 +21,79 @@ func Equals(t1, t2 Type) bool {
 	return deep.Equal(t1, t2) == nil
 }
 
-var (
-	nextVariableId   int
-	nextVariableIdMu sync.Mutex
-)
+// InferCtx owns the mutable state for a single type-inference run: the next
+// type-variable ID to hand out, and the union-find structure backing every
+// variable's binding. A fresh InferCtx per run keeps concurrent runs from
+// sharing state, unlike the old package-level counter and per-variable lock.
+type InferCtx struct {
+	nextID int
+	parent []Type // parent[id] is nil for an unbound variable, else its current binding.
+}
+
+// NewInferCtx returns an empty inference context, ready to mint variables.
+func NewInferCtx() *InferCtx {
+	return &InferCtx{}
+}
+
+// find returns the representative type v resolves to, path-compressing
+// every variable visited along the way.
+func (ctx *InferCtx) find(v *TypeVariable) Type {
+	var chain []*TypeVariable
+	cur := Type(v)
+	for {
+		tv, ok := cur.(*TypeVariable)
+		if !ok {
+			break
+		}
+		bound := ctx.parent[tv.Id]
+		if bound == nil {
+			break
+		}
+		chain = append(chain, tv)
+		cur = bound
+	}
+	for _, tv := range chain {
+		ctx.parent[tv.Id] = cur
+	}
+	return cur
+}
 
+// directBinding returns v's immediate binding without following the chain,
+// or nil if v is unbound.
+func (ctx *InferCtx) directBinding(v *TypeVariable) Type {
+	return ctx.parent[v.Id]
+}
+
+// bind records that v resolves to t.
+func (ctx *InferCtx) bind(v *TypeVariable, t Type) {
+	ctx.parent[v.Id] = t
+}
+
+// TypeVariable is a placeholder for a type to be determined by inference.
+// It belongs to exactly one InferCtx, which owns its binding.
 type TypeVariable struct {
-	Id         int
-	Instance   *Type
-	instanceMu sync.RWMutex
+	Id  int
+	ctx *InferCtx
 }
 
-func NewTypeVariable() *TypeVariable {
-	nextVariableIdMu.Lock()
-	id := nextVariableId
-	nextVariableId += 1
-	nextVariableIdMu.Unlock()
-	return &TypeVariable{Id: id}
+// NewTypeVariable allocates a fresh, unbound type variable owned by ctx.
+func NewTypeVariable(ctx *InferCtx) *TypeVariable {
+	id := ctx.nextID
+	ctx.nextID++
+	ctx.parent = append(ctx.parent, nil)
+	return &TypeVariable{Id: id, ctx: ctx}
 }
 
 func (t *TypeVariable) Root() Type {
-	t.instanceMu.Lock()
-	defer t.instanceMu.Unlock()
-	if t.Instance == nil {
-		return t
-	} else {
-		r := (*t.Instance).Root()
-		t.Instance = &r
-		return r
-	}
+	return t.ctx.find(t)
 }
 
 func (t *TypeVariable) String() string {
-	t.instanceMu.RLock()
-	defer t.instanceMu.RUnlock()
-	if t.Instance != nil {
-		return (*t.Instance).String()
+	r := t.Root()
+	if rv, ok := r.(*TypeVariable); ok && rv.Id == t.Id {
+		return fmt.Sprintf("typeVar%d", t.Id)
 	}
-	return fmt.Sprintf("typeVar%d", t.Id)
-
-}
-
-func (t *TypeVariable) SetInstance(t1 *Type) {
-	t.instanceMu.Lock()
-	defer t.instanceMu.Unlock()
-	t.Instance = t1
+	return r.String()
 }
 
 type TypeOperator struct {
@@ -90,37 +117,135 @@ func Function(args ...Type) Type {
 	return &TypeOperator{"→", args}
 }
 
+// TypeUnion represents a finite set of alternative TypeOperators a type
+// variable may be constrained to, e.g. `len: (String|Pattern)→Int`.
+// candidates is the current, possibly narrowed, membership.
+type TypeUnion struct {
+	Alternatives []*TypeOperator
+	candidates   []*TypeOperator
+}
+
+// NewTypeUnion constructs a TypeUnion whose candidate set is the full list
+// of alternatives.
+func NewTypeUnion(alts ...*TypeOperator) *TypeUnion {
+	candidates := make([]*TypeOperator, len(alts))
+	copy(candidates, alts)
+	return &TypeUnion{Alternatives: alts, candidates: candidates}
+}
+
+func (t *TypeUnion) Root() Type { return t }
+
+func (t *TypeUnion) String() string {
+	names := make([]string, len(t.candidates))
+	for i, c := range t.candidates {
+		names[i] = c.Name
+	}
+	return strings.Join(names, "|")
+}
+
+// has reports whether op is one of the union's current candidates.
+func (t *TypeUnion) has(op *TypeOperator) bool {
+	for _, c := range t.candidates {
+		if c.Name == op.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// narrow intersects t's candidate set with other's, returning an error
+// naming the residual constraints if no candidates remain in common.
+func (t *TypeUnion) narrow(other *TypeUnion) (*TypeUnion, error) {
+	var kept []*TypeOperator
+	for _, c := range t.candidates {
+		if other.has(c) {
+			kept = append(kept, c)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, fmt.Errorf("cannot infer type (constraints: %s, %s)", t, other)
+	}
+	return &TypeUnion{Alternatives: t.Alternatives, candidates: kept}, nil
+}
+
+// NewConstrainedTypeVariable returns a fresh TypeVariable, owned by ctx,
+// already bound to a TypeUnion of alts instead of left unbound.
+func NewConstrainedTypeVariable(ctx *InferCtx, alts ...*TypeOperator) *TypeVariable {
+	v := NewTypeVariable(ctx)
+	ctx.bind(v, NewTypeUnion(alts...))
+	return v
+}
+
 // Builtin types
 var (
-	Undef  = &TypeOperator{"Undef", []Type{}}
-	Error  = &TypeOperator{"Error", []Type{}}
-	None   = &TypeOperator{"None", []Type{}}
-	Int    = &TypeOperator{"Int", []Type{}}
-	Float  = &TypeOperator{"Float", []Type{}}
-	String = &TypeOperator{"String", []Type{}}
+	Undef     = &TypeOperator{"Undef", []Type{}}
+	Error     = &TypeOperator{"Error", []Type{}}
+	None      = &TypeOperator{"None", []Type{}}
+	Int       = &TypeOperator{"Int", []Type{}}
+	Float     = &TypeOperator{"Float", []Type{}}
+	String    = &TypeOperator{"String", []Type{}}
+	Timestamp = &TypeOperator{"Timestamp", []Type{}}
+	Pattern   = &TypeOperator{"Pattern", []Type{}}
 )
 
+// builtinCtx owns the template type variables embedded in Builtins.
+// FreshType copies them into the caller's InferCtx before each use.
+var builtinCtx = NewInferCtx()
+
+// absArg is shared between abs's argument and result positions so abs(x)
+// preserves x's type (Int or Float) instead of fixing one signature.
+var absArg = NewConstrainedTypeVariable(builtinCtx, Int, Float)
+
 var Builtins = map[string]Type{
 	"timestamp":   Function(Int),
-	"len":         Function(String, Int),
-	"settime":     Function(Int, None),
-	"strptime":    Function(String, None),
-	"strtol":      Function(String, Int),
+	"len":         Function(NewTypeUnion(String, Pattern), Int),
+	"settime":     Function(Timestamp, None),
+	"strptime":    Function(String, Timestamp),
+	"strtol":      Function(String, Int, Int),
 	"tolower":     Function(String, String),
 	"getfilename": Function(String),
+	"abs":         Function(absArg, absArg),
 }
 
-func FreshType(t Type, nongeneric []Type) Type {
+// FreshType copies t, replacing every generic type variable (one that
+// doesn't occur in nongeneric) with a new variable owned by ctx, so that
+// each use of a polymorphic type like a Builtins entry gets its own
+// independent variables rather than sharing bindings with other uses.
+// Variables that occur more than once in t are copied once and shared in
+// the result, preserving whatever relationship they encode (e.g. abs's
+// argument and result variable being the same one).
+func FreshType(ctx *InferCtx, t Type, nongeneric []Type) Type {
 	mappings := make(map[*TypeVariable]*TypeVariable, 0)
 
 	var freshRec func(Type) Type
 	freshRec = func(tp Type) Type {
+		// A type variable constrained by a TypeUnion (but not yet pinned to
+		// one of its members) must be handled before Root() resolves it
+		// away, so that every occurrence of the same variable freshens to
+		// the same new variable, carrying its own copy of the union.
+		if tv, ok := tp.(*TypeVariable); ok {
+			if b := tv.ctx.directBinding(tv); b != nil {
+				if _, isUnion := b.(*TypeUnion); isUnion {
+					if isGeneric(tv, nongeneric) {
+						if _, ok := mappings[tv]; !ok {
+							nv := NewTypeVariable(ctx)
+							fresh := freshRec(b)
+							ctx.bind(nv, fresh)
+							mappings[tv] = nv
+						}
+						return mappings[tv]
+					}
+					return tv
+				}
+			}
+		}
+
 		p := tp.Root()
 		switch p1 := p.(type) {
 		case *TypeVariable:
 			if isGeneric(p1, nongeneric) {
 				if _, ok := mappings[p1]; !ok {
-					mappings[p1] = NewTypeVariable()
+					mappings[p1] = NewTypeVariable(ctx)
 				}
 				return mappings[p1]
 			} else {
@@ -128,10 +253,14 @@ func FreshType(t Type, nongeneric []Type) Type {
 			}
 		case *TypeOperator:
 			args := make([]Type, len(p1.Args))
-			for _, arg := range p1.Args {
-				args = append(args, freshRec(arg))
+			for i, arg := range p1.Args {
+				args[i] = freshRec(arg)
 			}
 			return &TypeOperator{p1.Name, args}
+		case *TypeUnion:
+			candidates := make([]*TypeOperator, len(p1.candidates))
+			copy(candidates, p1.candidates)
+			return &TypeUnion{Alternatives: p1.Alternatives, candidates: candidates}
 		}
 		return nil
 	}
@@ -162,65 +291,120 @@ func occursInType(v *TypeVariable, t2 Type) bool {
 	return false
 }
 
-// Unify performs type unification of both parameter Types.  It returns the
-// least upper bound of both types, the smallest type that is capable of
-// representing both parameters.  If either type is a type variable, then that
-// variable is unified with the LUB.
-func Unify(a, b Type) error {
-	a1, b1 := a.Root(), b.Root()
-	switch a2 := a1.(type) {
+// scalarRank orders the builtin scalar types from least to most general, so
+// leastUpperBound can promote between them instead of requiring an exact
+// match.
+var scalarRank = map[string]int{
+	None.Name:   0,
+	Int.Name:    1,
+	Float.Name:  2,
+	String.Name: 3,
+}
+
+// leastUpperBound returns the smallest TypeOperator able to represent both a
+// and b. Undef unifies to whatever it meets; Error poisons the result; two
+// scalarRank types promote to the higher-ranked one; anything else must
+// match structurally.
+func leastUpperBound(ctx *InferCtx, a, b *TypeOperator) (Type, error) {
+	switch {
+	case a.Name == Error.Name || b.Name == Error.Name:
+		return Error, nil
+	case a.Name == Undef.Name:
+		return b, nil
+	case b.Name == Undef.Name:
+		return a, nil
+	}
+
+	ra, aok := scalarRank[a.Name]
+	rb, bok := scalarRank[b.Name]
+	if aok && bok {
+		if ra >= rb {
+			return a, nil
+		}
+		return b, nil
+	}
+
+	if a.Name != b.Name || len(a.Args) != len(b.Args) {
+		return nil, fmt.Errorf("type mismatch: %q != %q", a, b)
+	}
+	args := make([]Type, len(a.Args))
+	for i, argA := range a.Args {
+		lub, err := Unify(ctx, argA, b.Args[i])
+		if err != nil {
+			return nil, err
+		}
+		args[i] = lub
+	}
+	return &TypeOperator{a.Name, args}, nil
+}
+
+// unifyVariable unifies the type variable a against b. An unbound a is
+// bound to b; a already bound to T1 is widened to LUB(T1, b).
+func unifyVariable(ctx *InferCtx, a *TypeVariable, b Type) (Type, error) {
+	if bound := a.ctx.directBinding(a); bound != nil {
+		lub, err := Unify(ctx, bound, b)
+		if err != nil {
+			return nil, err
+		}
+		glog.V(2).Infof("Widening %q to %q", a, lub)
+		a.ctx.bind(a, lub)
+		return lub, nil
+	}
+	b1 := b.Root()
+	if b2, ok := b1.(*TypeVariable); ok && a.Id == b2.Id {
+		return a, nil
+	}
+	if occursInType(a, b1) {
+		return nil, fmt.Errorf("Recursive unification %v %v", a, b1)
+	}
+	glog.V(2).Infof("Making %q type %q", a, b1)
+	a.ctx.bind(a, b1)
+	return b1, nil
+}
+
+// unifyUnion unifies the union a against b. A concrete TypeOperator that is
+// one of a's candidates is returned as the result; another TypeUnion yields
+// a new union holding the intersection of the two candidate sets; an unbound
+// type variable is bound to a. a itself is never modified: a variable bound
+// to a is pinned or narrowed when unifyVariable rebinds it to the result.
+// Anything else is a type mismatch.
+func unifyUnion(ctx *InferCtx, a *TypeUnion, b Type) (Type, error) {
+	switch b1 := b.Root().(type) {
 	case *TypeVariable:
-		b2, ok := b1.(*TypeVariable)
-		if !ok || a2.Id != b2.Id {
-			if occursInType(a2, b1) {
-				return fmt.Errorf("Recursive unification %v %v", a2, b1)
-			}
-			glog.V(2).Infof("Making %q type %q", a2, b1)
-			a2.SetInstance(&b1)
-			return nil
+		return unifyVariable(ctx, b1, a)
+	case *TypeUnion:
+		return a.narrow(b1)
+	case *TypeOperator:
+		if !a.has(b1) {
+			return nil, fmt.Errorf("cannot infer type (constraints: %s): %q is not a member", a, b1)
 		}
+		return b1, nil
+	}
+	return nil, fmt.Errorf("cannot unify %q with %q", a, b)
+}
+
+// Unify performs type unification of both parameter Types, returning their
+// least upper bound (e.g. Int∪Float is Float, Int∪String is String). If
+// either type is a type variable, that variable is bound, or widened, to the
+// LUB. ctx must be the InferCtx that owns every variable being unified.
+func Unify(ctx *InferCtx, a, b Type) (Type, error) {
+	switch a1 := a.(type) {
+	case *TypeVariable:
+		return unifyVariable(ctx, a1, b)
+	case *TypeUnion:
+		return unifyUnion(ctx, a1, b)
 	case *TypeOperator:
-		switch b2 := b1.(type) {
+		switch b.(type) {
 		case *TypeVariable:
-			return Unify(b, a)
-
+			return Unify(ctx, b, a)
+		case *TypeUnion:
+			return Unify(ctx, b, a)
 		case *TypeOperator:
-			if a2.Name != b2.Name || len(a2.Args) != len(b2.Args) {
-				return fmt.Errorf("type mismatch: %q != %q", a2, b2)
-			}
-			for i, argA := range a2.Args {
-				err := Unify(argA, b2.Args[i])
-				if err != nil {
-					return err
-				}
-			}
-
-			// if Equals(a2, b2) {
-			// 	return a2
-			// }
-			// // least upper bound
-			// if (Equals(a2, Float) && Equals(b2, Int)) ||
-			// 	(Equals(b2, Float) && Equals(a2, Int)) {
-			// 	return Float
-			// }
-			// if (Equals(a2, String) && Equals(b2, Int)) ||
-			// 	(Equals(b2, String) && Equals(a2, Int)) ||
-			// 	(Equals(a2, String) && Equals(b2, Float)) ||
-			// 	(Equals(b2, String) && Equals(a2, Float)) {
-			// 	return String
-			// }
-
-			// if len(a2.Args) != len(b2.Args) {
-			// 	// TODO return error: glog.Errorf("Type mismatch: %q vs %q", a2, b2)
-			// 	return None
-			// }
-			// for i := range a2.Args {
-			// 	Unify(a2.Args[i], b2.Args[i])
-			// }
-			// return None
+			b1 := b.Root().(*TypeOperator)
+			return leastUpperBound(ctx, a1, b1)
 		}
 	}
-	return nil
+	return nil, fmt.Errorf("cannot unify %q with %q", a, b)
 }
 
 // inferCaprefType determines a type for a capturing group, based on contents
@@ -230,15 +414,204 @@ func inferCaprefType(re *syntax.Regexp, cap int) Type {
 	if group == nil {
 		return None
 	}
-	switch {
-	case groupOnlyMatches(group, "+-0123456789"):
-		return Int
-	case groupOnlyMatches(group, "+-0123456789.eE"):
-		return Float
-	}
-	// TODO: String.  Current behaviour of mtail before types is assume all
-	// matches are usable in arithmetic expressions.
-	return Int
+	// Only concrete scalar types appear in this walk, so a throwaway context
+	// is enough to satisfy Unify's signature; no variables are bound here.
+	ctx := NewInferCtx()
+	return inferGroupType(ctx, group)
+}
+
+// inferGroupType recursively walks a capture group to decide its scalar
+// type. Alternation takes the LUB of each alternative; concatenation infers
+// Timestamp if it looks like one, else String if two or more subexpressions
+// cannot match a digit, else String unless every subexpression is
+// individually numeric.
+func inferGroupType(ctx *InferCtx, re *syntax.Regexp) Type {
+	switch re.Op {
+	case syntax.OpCapture:
+		return inferGroupType(ctx, re.Sub[0])
+
+	case syntax.OpAlternate:
+		t := Type(Undef)
+		for _, sub := range re.Sub {
+			lub, err := Unify(ctx, t, inferGroupType(ctx, sub))
+			if err != nil {
+				return String
+			}
+			t = lub
+		}
+		return t
+
+	case syntax.OpConcat:
+		if looksLikeTimestamp(re) {
+			return Timestamp
+		}
+		// Two or more subexpressions that cannot match a digit means a delimited structure
+		// like an IP address or phone number, not a signed or decimal number.
+		if countNonDigitSubs(re) >= 2 {
+			return String
+		}
+		t := Type(Undef)
+		for _, sub := range re.Sub {
+			st := inferGroupType(ctx, sub)
+			if !Equals(st, Int) && !Equals(st, Float) {
+				return String
+			}
+			lub, err := Unify(ctx, t, st)
+			if err != nil {
+				return String
+			}
+			t = lub
+		}
+		return t
+
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat, syntax.OpQuest:
+		return inferGroupType(ctx, re.Sub[0])
+
+	default:
+		switch {
+		case groupOnlyMatches(re, "+-0123456789"):
+			return Int
+		case groupOnlyMatches(re, "+-0123456789.eE"):
+			return Float
+		}
+		return String
+	}
+}
+
+// countNonDigitSubs counts re's top-level subexpressions that cannot match a
+// digit, e.g. the three "." in an IPv4 pattern or the two "-" in a phone
+// number.
+func countNonDigitSubs(re *syntax.Regexp) int {
+	n := 0
+	for _, sub := range re.Sub {
+		if !groupContainsDigit(sub) {
+			n++
+		}
+	}
+	return n
+}
+
+// groupContainsDigit reports whether re can match at least one digit.
+func groupContainsDigit(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if r >= '0' && r <= '9' {
+				return true
+			}
+		}
+		return false
+	case syntax.OpCharClass:
+		for i := 0; i < len(re.Rune); i += 2 {
+			lo, hi := re.Rune[i], re.Rune[i+1]
+			if lo <= '9' && hi >= '0' {
+				return true
+			}
+		}
+		return false
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return true
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat, syntax.OpQuest, syntax.OpCapture:
+		return groupContainsDigit(re.Sub[0])
+	case syntax.OpConcat, syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if groupContainsDigit(sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tsLayout is one recognised date/time/datetime shape: a sequence of
+// fixed-width digit runs joined by separators drawn from a fixed charset per
+// position.
+type tsLayout struct {
+	widths []int
+	seps   []string // len(widths)-1 allowed separator runes, one set per gap
+}
+
+var timestampLayouts = []tsLayout{
+	{widths: []int{4, 2, 2}, seps: []string{"-/", "-/"}},                          // 2006-01-02
+	{widths: []int{2, 2, 2}, seps: []string{"-/", "-/"}},                          // 06-01-02
+	{widths: []int{2, 2, 2}, seps: []string{":", ":"}},                            // 15:04:05
+	{widths: []int{4, 2, 2, 2, 2, 2}, seps: []string{"-/", "-/", "T ", ":", ":"}}, // 2006-01-02T15:04:05
+}
+
+// looksLikeTimestamp reports whether re is fixed-width digit runs and
+// separators matching one of timestampLayouts, e.g.
+// `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}`.
+func looksLikeTimestamp(re *syntax.Regexp) bool {
+	if re.Op != syntax.OpConcat || len(re.Sub)%2 != 1 {
+		return false
+	}
+	n := (len(re.Sub) + 1) / 2
+	widths := make([]int, n)
+	seps := make([]*syntax.Regexp, n-1)
+	for i, sub := range re.Sub {
+		if i%2 == 0 {
+			w, ok := digitRunWidth(sub)
+			if !ok {
+				return false
+			}
+			widths[i/2] = w
+		} else {
+			seps[i/2] = sub
+		}
+	}
+	for _, layout := range timestampLayouts {
+		if matchesLayout(widths, seps, layout) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesLayout(widths []int, seps []*syntax.Regexp, layout tsLayout) bool {
+	if len(widths) != len(layout.widths) {
+		return false
+	}
+	for i, w := range widths {
+		if w != layout.widths[i] {
+			return false
+		}
+	}
+	for i, sep := range seps {
+		if !groupOnlyMatches(sep, layout.seps[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// digitRunWidth returns the exact number of digits re matches, looking
+// through capture and fixed-count repetition (e.g. `\d{4}`). It reports
+// ok=false for anything of variable width, such as `\d+` or `\d{1,3}`.
+func digitRunWidth(re *syntax.Regexp) (int, bool) {
+	switch re.Op {
+	case syntax.OpCapture:
+		return digitRunWidth(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min != re.Max {
+			return 0, false
+		}
+		w, ok := digitRunWidth(re.Sub[0])
+		if !ok {
+			return 0, false
+		}
+		return w * re.Min, true
+	case syntax.OpLiteral:
+		if !groupOnlyMatches(re, "0123456789") {
+			return 0, false
+		}
+		return len(re.Rune), true
+	case syntax.OpCharClass:
+		if !groupOnlyMatches(re, "0123456789") {
+			return 0, false
+		}
+		return 1, true
+	}
+	return 0, false
 }
 
 // getCaptureGroup returns the Regexp node of the capturing group numbered cap
@@ -0,0 +1,230 @@
+// Copyright 2016 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp/syntax"
+	"sync"
+	"testing"
+)
+
+func mustParse(t *testing.T, pattern string) *syntax.Regexp {
+	t.Helper()
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		t.Fatalf("syntax.Parse(%q): %v", pattern, err)
+	}
+	return re
+}
+
+func TestInferCaprefType(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    Type
+	}{
+		// Common Apache/nginx/syslog capture shapes.
+		{`(\d+)`, Int},
+		{`(-?\d+)`, Int},
+		{`(\d+\.\d+)`, Float},
+		{`(\w+)`, String},
+		{`(GET|POST|PUT|DELETE)`, String},
+		{`(\d{3})`, Int}, // HTTP status code
+		{`(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2})`, Timestamp},
+		{`(\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2})`, Timestamp},
+
+		// Adversarial shapes that resemble a timestamp's digits-and-
+		// separators structure but are not one.
+		{`(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})`, String},  // IPv4 address
+		{`(\d+\.\d+\.\d+)`, String},                       // semver
+		{`(\d{2}:\d{2}:\d{2}:\d{2}:\d{2}:\d{2})`, String}, // MAC address
+		{`(\d{3}-\d{3}-\d{4})`, String},                   // phone number
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			re := mustParse(t, tc.pattern)
+			got := inferCaprefType(re, 1)
+			if !Equals(got, tc.want) {
+				t.Errorf("inferCaprefType(%q) = %v, want %v", tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLooksLikeTimestamp(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		want    bool
+	}{
+		{`\d{4}-\d{2}-\d{2}`, true},
+		{`\d{2}:\d{2}:\d{2}`, true},
+		{`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}`, true},
+		{`\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}`, false},
+		{`\d+\.\d+\.\d+`, false},
+		{`\d{2}:\d{2}:\d{2}:\d{2}:\d{2}:\d{2}`, false},
+		{`\d{3}-\d{3}-\d{4}`, false},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			re := mustParse(t, "("+tc.pattern+")")
+			group := getCaptureGroup(re, 1).Sub[0]
+			if got := looksLikeTimestamp(group); got != tc.want {
+				t.Errorf("looksLikeTimestamp(%q) = %v, want %v", tc.pattern, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLeastUpperBound(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b *TypeOperator
+		want Type
+	}{
+		{"Int-Float", Int, Float, Float},
+		{"Int-String", Int, String, String},
+		{"Float-String", Float, String, String},
+		{"Error-poisons", Error, Int, Error},
+		{"Undef-absorbed", Undef, Int, Int},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := NewInferCtx()
+			got, err := leastUpperBound(ctx, tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("leastUpperBound(%q, %q): %v", tc.a, tc.b, err)
+			}
+			if !Equals(got, tc.want) {
+				t.Errorf("leastUpperBound(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("structural-mismatch", func(t *testing.T) {
+		ctx := NewInferCtx()
+		a := &TypeOperator{"Foo", []Type{Int}}
+		b := &TypeOperator{"Bar", []Type{Int, Int}}
+		if _, err := leastUpperBound(ctx, a, b); err == nil {
+			t.Errorf("leastUpperBound(%q, %q) = nil error, want mismatch error", a, b)
+		}
+	})
+}
+
+func TestUnify(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b Type
+		want Type
+	}{
+		{"Int-Float", Int, Float, Float},
+		{"Int-String", Int, String, String},
+		{"Float-String", Float, String, String},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := NewInferCtx()
+			got, err := Unify(ctx, tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("Unify(%q, %q): %v", tc.a, tc.b, err)
+			}
+			if !Equals(got, tc.want) {
+				t.Errorf("Unify(%q, %q) = %v, want %v", tc.a, tc.b, got, tc.want)
+			}
+		})
+	}
+
+	t.Run("structural-mismatch", func(t *testing.T) {
+		ctx := NewInferCtx()
+		a := &TypeOperator{"Foo", []Type{Int}}
+		b := &TypeOperator{"Bar", []Type{Int, Int}}
+		if _, err := Unify(ctx, a, b); err == nil {
+			t.Errorf("Unify(%q, %q) = nil error, want mismatch error", a, b)
+		}
+	})
+
+	t.Run("variable-widened-across-calls", func(t *testing.T) {
+		ctx := NewInferCtx()
+		v := NewTypeVariable(ctx)
+		if _, err := Unify(ctx, v, Int); err != nil {
+			t.Fatalf("Unify(v, Int): %v", err)
+		}
+		if _, err := Unify(ctx, v, Float); err != nil {
+			t.Fatalf("Unify(v, Float): %v", err)
+		}
+		if !Equals(v.Root(), Float) {
+			t.Errorf("v.Root() = %v, want %v", v.Root(), Float)
+		}
+	})
+}
+
+func TestTypeUnionLen(t *testing.T) {
+	ctx := NewInferCtx()
+	fresh := FreshType(ctx, Builtins["len"], nil).(*TypeOperator)
+	argType := fresh.Args[0]
+
+	if _, err := Unify(ctx, argType, String); err != nil {
+		t.Errorf("Unify(len's arg, String): %v", err)
+	}
+
+	ctx2 := NewInferCtx()
+	fresh2 := FreshType(ctx2, Builtins["len"], nil).(*TypeOperator)
+	if _, err := Unify(ctx2, fresh2.Args[0], Pattern); err != nil {
+		t.Errorf("Unify(len's arg, Pattern): %v", err)
+	}
+
+	ctx3 := NewInferCtx()
+	fresh3 := FreshType(ctx3, Builtins["len"], nil).(*TypeOperator)
+	if _, err := Unify(ctx3, fresh3.Args[0], Int); err == nil {
+		t.Errorf("Unify(len's arg, Int) = nil error, want \"cannot infer type\" error")
+	}
+}
+
+func TestTypeUnionNarrowEmpty(t *testing.T) {
+	a := NewTypeUnion(Int, Float)
+	b := NewTypeUnion(String, Pattern)
+	if _, err := a.narrow(b); err == nil {
+		t.Errorf("narrow(%q, %q) = nil error, want \"cannot infer type\" error", a, b)
+	}
+}
+
+// TestFreshTypeAbs confirms two independent FreshType instantiations of abs's
+// shared argument/result variable don't cross-contaminate each other.
+func TestFreshTypeAbs(t *testing.T) {
+	ctx1 := NewInferCtx()
+	abs1 := FreshType(ctx1, Builtins["abs"], nil).(*TypeOperator)
+	if _, err := Unify(ctx1, abs1.Args[0], Int); err != nil {
+		t.Fatalf("Unify(abs1 arg, Int): %v", err)
+	}
+
+	ctx2 := NewInferCtx()
+	abs2 := FreshType(ctx2, Builtins["abs"], nil).(*TypeOperator)
+	if _, err := Unify(ctx2, abs2.Args[0], Float); err != nil {
+		t.Fatalf("Unify(abs2 arg, Float): %v", err)
+	}
+
+	if !Equals(abs1.Args[1].Root(), Int) {
+		t.Errorf("abs1.Args[1].Root() = %v, want %v", abs1.Args[1].Root(), Int)
+	}
+	if !Equals(abs2.Args[1].Root(), Float) {
+		t.Errorf("abs2.Args[1].Root() = %v, want %v", abs2.Args[1].Root(), Float)
+	}
+}
+
+// TestInferCtxConcurrent runs independent inference sessions in parallel, on
+// separate InferCtxs, to confirm they don't share mutable state. Run with
+// -race to check for data races.
+func TestInferCtxConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := NewInferCtx()
+			v := NewTypeVariable(ctx)
+			if _, err := Unify(ctx, v, Int); err != nil {
+				t.Errorf("Unify: %v", err)
+				return
+			}
+			if !Equals(v.Root(), Int) {
+				t.Errorf("v.Root() = %v, want %v", v.Root(), Int)
+			}
+		}()
+	}
+	wg.Wait()
+}